@@ -0,0 +1,143 @@
+package service
+
+import (
+	"net"
+	"sync"
+)
+
+// Event is implemented by everything a Broadcaster can fan out. Topic
+// identifies the event for Subscribe's filter.
+type Event interface {
+	Topic() string
+}
+
+// TCPAcceptEvent fires as soon as mux() pulls a new connection off
+// connectionChan, before any handshake is attempted.
+type TCPAcceptEvent struct {
+	Addr net.Addr
+}
+
+func (TCPAcceptEvent) Topic() string { return "tcp.accept" }
+
+// HandshakeFailedEvent fires when a connection's TLS or Skynet
+// handshake fails - Err is whichever of those produced the error.
+type HandshakeFailedEvent struct {
+	Addr net.Addr
+	Err  error
+}
+
+func (HandshakeFailedEvent) Topic() string { return "client.handshake_failed" }
+
+// ClientConnectedEvent fires once a connection's handshake succeeds
+// and it's about to start being served RPCs.
+type ClientConnectedEvent struct {
+	ClientID string
+	Addr     net.Addr
+}
+
+func (ClientConnectedEvent) Topic() string { return "client.connected" }
+
+// ClientDisconnectedEvent fires when a previously-connected client's
+// RPCServ.ServeCodec loop returns, i.e. the connection closed.
+type ClientDisconnectedEvent struct {
+	ClientID string
+	Addr     net.Addr
+}
+
+func (ClientDisconnectedEvent) Topic() string { return "client.disconnected" }
+
+// RegisteredEvent fires whenever the service transitions into the
+// registered (accepting requests) state.
+type RegisteredEvent struct{}
+
+func (RegisteredEvent) Topic() string { return "service.registered" }
+
+// UnregisteredEvent fires whenever the service transitions out of the
+// registered state.
+type UnregisteredEvent struct{}
+
+func (UnregisteredEvent) Topic() string { return "service.unregistered" }
+
+// eventBufferLen is how many pending Events a Subscribe channel holds
+// before Publish starts dropping for that subscriber.
+const eventBufferLen = 16
+
+// Broadcaster fans typed Events out to subscribers by topic, modeled
+// on the skywire appevent broadcaster: Publish never blocks on a slow
+// subscriber, it drops that event and counts the drop instead.
+type Broadcaster struct {
+	mu sync.Mutex
+	// subscribers maps each subscriber's channel to its topic filter;
+	// a nil filter means "every topic".
+	subscribers map[chan Event]map[string]bool
+	dropped     uint64
+}
+
+// NewBroadcaster returns an empty Broadcaster ready to Subscribe and Publish to.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subscribers: make(map[chan Event]map[string]bool)}
+}
+
+// Subscribe returns a channel that receives every future Event whose
+// Topic is in topics, or every Event if topics is empty. The channel
+// is buffered; a subscriber that falls behind has events dropped
+// rather than blocking Publish - see Dropped.
+func (b *Broadcaster) Subscribe(topics ...string) <-chan Event {
+	ch := make(chan Event, eventBufferLen)
+
+	var filter map[string]bool
+	if len(topics) > 0 {
+		filter = make(map[string]bool, len(topics))
+		for _, t := range topics {
+			filter[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.subscribers[ch] = filter
+	b.mu.Unlock()
+
+	return ch
+}
+
+// Unsubscribe stops delivering to a channel returned by Subscribe and closes it.
+func (b *Broadcaster) Unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.subscribers {
+		if c == ch {
+			delete(b.subscribers, c)
+			close(c)
+			return
+		}
+	}
+}
+
+// Dropped returns how many events have been dropped so far because a
+// subscriber's channel was full.
+func (b *Broadcaster) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// Publish fans e out to every subscriber whose filter matches
+// e.Topic(). Delivery never blocks the caller: a full subscriber
+// channel has the event dropped and counted instead.
+func (b *Broadcaster) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, filter := range b.subscribers {
+		if filter != nil && !filter[e.Topic()] {
+			continue
+		}
+
+		select {
+		case ch <- e:
+		default:
+			b.dropped++
+		}
+	}
+}
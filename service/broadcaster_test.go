@@ -0,0 +1,83 @@
+package service
+
+import "testing"
+
+func TestBroadcasterFiltersByTopic(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe("service.registered")
+
+	b.Publish(RegisteredEvent{})
+	b.Publish(UnregisteredEvent{})
+
+	select {
+	case e := <-ch:
+		if e.Topic() != "service.registered" {
+			t.Fatalf("got topic %q, want service.registered", e.Topic())
+		}
+	default:
+		t.Fatal("expected the matching event to be delivered")
+	}
+
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected second event %+v - UnregisteredEvent shouldn't match this filter", e)
+	default:
+	}
+}
+
+func TestBroadcasterSubscribeAllTopics(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe()
+
+	b.Publish(RegisteredEvent{})
+	b.Publish(UnregisteredEvent{})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("expected event %d to be delivered to an unfiltered subscriber", i)
+		}
+	}
+}
+
+func TestBroadcasterDropsWhenSubscriberFull(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe()
+
+	for i := 0; i < eventBufferLen+5; i++ {
+		b.Publish(RegisteredEvent{})
+	}
+
+	if b.Dropped() == 0 {
+		t.Fatal("expected Publish to drop events once the subscriber's buffer filled")
+	}
+
+	count := 0
+drain:
+	for {
+		select {
+		case <-ch:
+			count++
+		default:
+			break drain
+		}
+	}
+	if count != eventBufferLen {
+		t.Fatalf("got %d buffered events, want %d", count, eventBufferLen)
+	}
+}
+
+func TestBroadcasterUnsubscribeClosesChannel(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe()
+
+	b.Unsubscribe(ch)
+
+	if _, ok := <-ch; ok {
+		t.Fatal("expected the channel to be closed after Unsubscribe")
+	}
+
+	// Publish after Unsubscribe must not panic or re-deliver.
+	b.Publish(RegisteredEvent{})
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/skynetservices/skynet2"
+	"github.com/skynetservices/skynet2/rpc/bsonrpc"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+)
+
+// Codec lets Service speak more than one wire protocol on the same
+// listener. Name identifies the codec for logging/registration,
+// Matches sniffs a connection's first few bytes (see connSniffer) to
+// decide whether this codec should handle it, NewServerCodec adapts
+// the connection (post-handshake) into the standard library's
+// rpc.ServerCodec, and {En,De}codeHandshake perform the Skynet
+// service/client handshake in that codec's encoding.
+type Codec interface {
+	Name() string
+	Matches(prefix []byte) bool
+	NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec
+	EncodeHandshake(w io.Writer, sh skynet.ServiceHandshake) error
+	DecodeHandshake(r io.Reader) (ch skynet.ClientHandshake, err error)
+}
+
+// codecSniffLen is how many bytes of a new connection we peek at to
+// pick a Codec. It needs to cover the longest preamble a Matches
+// implementation looks for; 24 is the length of the HTTP/2 client
+// preface, which looksLikeGRPC peeks separately rather than through a
+// Codec.
+const codecSniffLen = 24
+
+// connSniffer lets a Codec's Matches peek at a connection's leading
+// bytes without consuming them, so whichever Codec ends up handling
+// the connection still sees those bytes on its first Read. It wraps
+// net.Conn, not just io.ReadWriteCloser, so a sniffed connection can
+// still be handed to a *grpc.Server listener or tracked in ClientInfo.
+type connSniffer struct {
+	r    *bufio.Reader
+	conn net.Conn
+}
+
+func newConnSniffer(conn net.Conn) *connSniffer {
+	return &connSniffer{r: bufio.NewReader(conn), conn: conn}
+}
+
+func (cs *connSniffer) Read(p []byte) (int, error)  { return cs.r.Read(p) }
+func (cs *connSniffer) Write(p []byte) (int, error) { return cs.conn.Write(p) }
+func (cs *connSniffer) Close() error                { return cs.conn.Close() }
+
+func (cs *connSniffer) LocalAddr() net.Addr  { return cs.conn.LocalAddr() }
+func (cs *connSniffer) RemoteAddr() net.Addr { return cs.conn.RemoteAddr() }
+
+func (cs *connSniffer) SetDeadline(t time.Time) error      { return cs.conn.SetDeadline(t) }
+func (cs *connSniffer) SetReadDeadline(t time.Time) error  { return cs.conn.SetReadDeadline(t) }
+func (cs *connSniffer) SetWriteDeadline(t time.Time) error { return cs.conn.SetWriteDeadline(t) }
+
+// Peek returns the next n bytes without advancing the read position.
+// It may return fewer than n bytes (with io.EOF or another error) if
+// the connection hasn't sent that much yet.
+func (cs *connSniffer) Peek(n int) ([]byte, error) { return cs.r.Peek(n) }
+
+// codecSniffTimeout bounds how long selectCodec will wait for a
+// connection's first bytes before giving up and falling back to
+// s.defaultCodec. The default BSON handshake has the server speak
+// first, so a connection bound for it may have nothing to Peek at -
+// without this, selectCodec would block that connection's handler
+// goroutine forever.
+const codecSniffTimeout = 50 * time.Millisecond
+
+// selectCodec peeks cs's leading bytes and returns the first
+// registered Codec whose Matches claims them, falling back to
+// s.defaultCodec (BSONCodec) when none do - preserving the original
+// Skynet wire format as the default. It skips the peek entirely when
+// no codecs are registered, the common case.
+func (s *Service) selectCodec(cs *connSniffer) Codec {
+	if len(s.codecs) == 0 {
+		return s.defaultCodec
+	}
+
+	cs.SetReadDeadline(time.Now().Add(codecSniffTimeout))
+	prefix, _ := cs.Peek(codecSniffLen)
+	cs.SetReadDeadline(time.Time{})
+
+	for _, c := range s.codecs {
+		if c.Matches(prefix) {
+			return c
+		}
+	}
+
+	return s.defaultCodec
+}
+
+// RegisterCodec adds an additional wire protocol connections can be
+// routed to when c.Matches claims them during the handshake peek. The
+// BSON codec remains the default for connections no registered Codec
+// matches.
+func (s *Service) RegisterCodec(c Codec) {
+	s.codecs = append(s.codecs, c)
+}
+
+// BSONCodec is Skynet's original wire format. It is always
+// s.defaultCodec and never needs to win a sniff match.
+type BSONCodec struct{}
+
+func (BSONCodec) Name() string               { return "bsonrpc" }
+func (BSONCodec) Matches(prefix []byte) bool { return false }
+func (BSONCodec) NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return bsonrpc.NewServerCodec(conn)
+}
+
+func (BSONCodec) EncodeHandshake(w io.Writer, sh skynet.ServiceHandshake) error {
+	return bsonrpc.NewEncoder(w).Encode(sh)
+}
+
+func (BSONCodec) DecodeHandshake(r io.Reader) (ch skynet.ClientHandshake, err error) {
+	err = bsonrpc.NewDecoder(r).Decode(&ch)
+	return
+}
+
+// JSONCodec speaks the standard net/rpc/jsonrpc wire format, so plain
+// JSON-RPC clients - including non-Go ones - can talk to a Skynet
+// service without linking bsonrpc.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string { return "jsonrpc" }
+
+func (JSONCodec) Matches(prefix []byte) bool {
+	for _, b := range prefix {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func (JSONCodec) NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return jsonrpc.NewServerCodec(conn)
+}
+
+func (JSONCodec) EncodeHandshake(w io.Writer, sh skynet.ServiceHandshake) error {
+	return json.NewEncoder(w).Encode(sh)
+}
+
+func (JSONCodec) DecodeHandshake(r io.Reader) (ch skynet.ClientHandshake, err error) {
+	err = json.NewDecoder(r).Decode(&ch)
+	return
+}
+
+// GobCodec speaks vanilla net/rpc (encoding/gob), for callers using
+// Go's standard library client directly rather than bsonrpc. Gob has
+// no reliable magic prefix to sniff, so Matches is always false and
+// selectCodec never picks GobCodec: registering it with RegisterCodec
+// routes no connection to it.
+type GobCodec struct{}
+
+func (GobCodec) Name() string               { return "gob" }
+func (GobCodec) Matches(prefix []byte) bool { return false }
+
+func (GobCodec) NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return newGobServerCodec(conn)
+}
+
+func (GobCodec) EncodeHandshake(w io.Writer, sh skynet.ServiceHandshake) error {
+	return gob.NewEncoder(w).Encode(sh)
+}
+
+func (GobCodec) DecodeHandshake(r io.Reader) (ch skynet.ClientHandshake, err error) {
+	err = gob.NewDecoder(r).Decode(&ch)
+	return
+}
+
+// gobServerCodec is net/rpc's own (unexported) gob wire format,
+// reimplemented here since net/rpc doesn't export a constructor for
+// it - only for its client-side counterpart.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob stream is now out of sync - the connection is dead.
+			c.Close()
+		}
+		return
+	}
+
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return
+	}
+
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	return c.rwc.Close()
+}
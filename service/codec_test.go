@@ -0,0 +1,109 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn backed by an in-memory byte slice, for
+// feeding selectCodec a deterministic prefix without a real socket.
+type fakeConn struct {
+	data []byte
+	pos  int
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	if c.pos >= len(c.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+func (c *fakeConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *fakeConn) Close() error                       { return nil }
+func (c *fakeConn) LocalAddr() net.Addr                { return fakeAddr{} }
+func (c *fakeConn) RemoteAddr() net.Addr               { return fakeAddr{} }
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type fakeAddr struct{}
+
+func (fakeAddr) Network() string { return "fake" }
+func (fakeAddr) String() string  { return "fake" }
+
+func TestJSONCodecMatches(t *testing.T) {
+	cases := []struct {
+		prefix []byte
+		want   bool
+	}{
+		{[]byte(`{"method":"x"}`), true},
+		{[]byte("   {\"a\":1}"), true},
+		{[]byte("PRI * HTTP/2.0"), false},
+		{[]byte{}, false},
+	}
+
+	for _, c := range cases {
+		if got := (JSONCodec{}).Matches(c.prefix); got != c.want {
+			t.Errorf("Matches(%q) = %v, want %v", c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestBSONAndGobCodecsNeverMatch(t *testing.T) {
+	if (BSONCodec{}).Matches([]byte("anything")) {
+		t.Fatal("BSONCodec.Matches should always be false - it's the fallback default")
+	}
+	if (GobCodec{}).Matches([]byte("anything")) {
+		t.Fatal("GobCodec.Matches should always be false - gob has no sniffable prefix")
+	}
+}
+
+func TestSelectCodecSkipsPeekWithNoCodecsRegistered(t *testing.T) {
+	s := &Service{defaultCodec: BSONCodec{}}
+
+	// cs is nil - if selectCodec tried to Peek through it, this would
+	// panic instead of returning. With no codecs registered it must
+	// short-circuit before ever touching cs.
+	got := s.selectCodec(nil)
+	if _, ok := got.(BSONCodec); !ok {
+		t.Fatalf("got %T, want BSONCodec", got)
+	}
+}
+
+func TestSelectCodecMatchesRegisteredCodec(t *testing.T) {
+	s := &Service{
+		defaultCodec: BSONCodec{},
+		codecs:       []Codec{JSONCodec{}},
+	}
+
+	cs := newConnSniffer(&fakeConn{data: []byte(`{"method":"foo"}`)})
+
+	got := s.selectCodec(cs)
+	if _, ok := got.(JSONCodec); !ok {
+		t.Fatalf("got %T, want JSONCodec", got)
+	}
+}
+
+func TestSelectCodecFallsBackOnNoData(t *testing.T) {
+	s := &Service{
+		defaultCodec: BSONCodec{},
+		codecs:       []Codec{JSONCodec{}},
+	}
+
+	// Nothing has been written to this connection yet - the default
+	// BSON case, where the server speaks first. fakeConn reports EOF at
+	// once instead of blocking, so this checks that an empty prefix
+	// falls back to the default codec; it does not exercise the sniff
+	// timeout itself.
+	cs := newConnSniffer(&fakeConn{})
+
+	got := s.selectCodec(cs)
+	if _, ok := got.(BSONCodec); !ok {
+		t.Fatalf("got %T, want BSONCodec", got)
+	}
+}
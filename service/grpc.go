@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"github.com/skynetservices/skynet2/log"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"net"
+	"time"
+)
+
+// http2Preface is the HTTP/2 connection preface every gRPC client
+// sends first; matching on it is how the connection dispatcher tells
+// gRPC traffic apart from Skynet's own codecs.
+var http2Preface = []byte(http2.ClientPreface)
+
+// isGRPCConn reports whether prefix is (the start of) the HTTP/2
+// client preface. An empty prefix - what cs.Peek returns once the
+// codec-sniff timeout elapses on a connection that hasn't sent
+// anything yet, the default BSON case - is not a match: bytes.HasPrefix
+// treats "" as a prefix of everything, which would otherwise route
+// every silent default-codec connection into the gRPC listener.
+func isGRPCConn(prefix []byte) bool {
+	if len(prefix) == 0 {
+		return false
+	}
+	return bytes.HasPrefix(http2Preface, prefix) || bytes.HasPrefix(prefix, http2Preface)
+}
+
+// looksLikeGRPC peeks cs's leading bytes, bounded by codecSniffTimeout,
+// and reports whether they're the HTTP/2 client preface (isGRPCConn).
+// handleConnection uses it to decide whether a connection should go to
+// RegisterGRPCService's server instead of through the normal codec
+// dispatch; the timeout keeps a silent default-codec connection from
+// blocking that decision forever.
+func looksLikeGRPC(cs *connSniffer) bool {
+	cs.SetReadDeadline(time.Now().Add(codecSniffTimeout))
+	prefix, _ := cs.Peek(len(http2Preface))
+	cs.SetReadDeadline(time.Time{})
+
+	return isGRPCConn(prefix)
+}
+
+// grpcListener adapts a channel of connections sniffed off Service's
+// own listener into a net.Listener, so a *grpc.Server can Serve() them
+// without owning its own socket - the same trick cmux uses to let a
+// grpc.Server and other protocols share one port.
+type grpcListener struct {
+	addr  net.Addr
+	connC chan net.Conn
+	done  chan bool
+}
+
+func newGRPCListener(addr net.Addr) *grpcListener {
+	return &grpcListener{addr: addr, connC: make(chan net.Conn), done: make(chan bool)}
+}
+
+func (l *grpcListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connC:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("service: grpc listener closed")
+	}
+}
+
+func (l *grpcListener) Close() error {
+	close(l.done)
+	return nil
+}
+
+func (l *grpcListener) Addr() net.Addr { return l.addr }
+
+// RegisterGRPCService bolts a gRPC service onto the same listener as
+// the rest of Service's codecs. The first call lazily creates the
+// *grpc.Server and starts it serving connections the dispatcher in
+// mux() routes to it by the HTTP/2 preface; later calls just register
+// additional services on the same server, same as grpc.Server.RegisterService.
+func (s *Service) RegisterGRPCService(desc *grpc.ServiceDesc, impl interface{}) {
+	if s.grpcServer == nil {
+		var addr net.Addr
+		if s.rpcListener != nil {
+			addr = s.rpcListener.Addr()
+		}
+
+		s.grpcServer = grpc.NewServer()
+		s.grpcListener = newGRPCListener(addr)
+
+		go func() {
+			err := s.grpcServer.Serve(s.grpcListener)
+			if err != nil {
+				log.Println(log.ERROR, "grpc.Server.Serve exited: "+err.Error())
+			}
+		}()
+	}
+
+	s.grpcServer.RegisterService(desc, impl)
+}
@@ -0,0 +1,49 @@
+package service
+
+import "testing"
+
+func TestIsGRPCConnRejectsEmptyPrefix(t *testing.T) {
+	if isGRPCConn(nil) {
+		t.Fatal("isGRPCConn(nil) must be false - an empty prefix means no bytes arrived, not a match")
+	}
+	if isGRPCConn([]byte{}) {
+		t.Fatal("isGRPCConn([]byte{}) must be false")
+	}
+}
+
+func TestIsGRPCConnMatchesPreface(t *testing.T) {
+	if !isGRPCConn(http2Preface) {
+		t.Fatal("expected the full HTTP/2 client preface to match")
+	}
+	if !isGRPCConn(http2Preface[:4]) {
+		t.Fatal("expected a leading chunk of the preface to match (more bytes may still be arriving)")
+	}
+}
+
+func TestIsGRPCConnRejectsNonGRPCTraffic(t *testing.T) {
+	if isGRPCConn([]byte("not a grpc connection at all")) {
+		t.Fatal("expected unrelated traffic not to match")
+	}
+}
+
+// TestLooksLikeGRPCFallsBackOnSilentConnection exercises the same
+// no-data case a plain BSON client hits when a *grpc.Server has been
+// registered: nothing has been written yet, so looksLikeGRPC must
+// report false rather than misrouting the connection into the gRPC
+// listener. fakeConn reports EOF at once instead of blocking, so the
+// sniff timeout itself is not exercised here.
+func TestLooksLikeGRPCFallsBackOnSilentConnection(t *testing.T) {
+	cs := newConnSniffer(&fakeConn{})
+
+	if looksLikeGRPC(cs) {
+		t.Fatal("expected a connection with no data yet to not look like gRPC")
+	}
+}
+
+func TestLooksLikeGRPCMatchesRealPreface(t *testing.T) {
+	cs := newConnSniffer(&fakeConn{data: http2Preface})
+
+	if !looksLikeGRPC(cs) {
+		t.Fatal("expected a connection sending the HTTP/2 preface to look like gRPC")
+	}
+}
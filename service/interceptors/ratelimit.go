@@ -0,0 +1,97 @@
+package interceptors
+
+import (
+	"context"
+	"errors"
+	"github.com/skynetservices/skynet2/service"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a client has exhausted its token
+// bucket under RateLimit.
+var ErrRateLimited = errors.New("service: rate limit exceeded")
+
+// RateLimit returns an Interceptor enforcing a per-client token-bucket
+// limit of rps requests/sec, keyed by MethodInfo.ClientID. It
+// subscribes to s's client.disconnected events to evict a client's
+// bucket once its connection closes, so buckets don't accumulate
+// forever for a service with many short-lived clients.
+func RateLimit(s *service.Service, rps int) service.Interceptor {
+	rl := &rateLimiter{rps: rps, buckets: make(map[string]*tokenBucket)}
+
+	go rl.evictOnDisconnect(s.Subscribe("client.disconnected"))
+
+	return func(ctx context.Context, info service.MethodInfo, req, resp interface{}, next service.Handler) error {
+		if !rl.allow(info.ClientID) {
+			return ErrRateLimited
+		}
+
+		return next(ctx, req, resp)
+	}
+}
+
+// tokenBucket refills at rps tokens/sec up to a cap of rps, so a
+// client can burst up to one second's worth of requests.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	lastFill time.Time
+}
+
+type rateLimiter struct {
+	rps int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// evictOnDisconnect deletes a client's bucket as soon as it
+// disconnects, until events closes. Run in its own goroutine by
+// RateLimit.
+func (rl *rateLimiter) evictOnDisconnect(events <-chan service.Event) {
+	for e := range events {
+		disconnect, ok := e.(service.ClientDisconnectedEvent)
+		if !ok {
+			continue
+		}
+
+		rl.mu.Lock()
+		delete(rl.buckets, disconnect.ClientID)
+		rl.mu.Unlock()
+	}
+}
+
+func (rl *rateLimiter) bucketFor(clientID string) *tokenBucket {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[clientID]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rl.rps), lastFill: time.Now()}
+		rl.buckets[clientID] = b
+	}
+
+	return b
+}
+
+func (rl *rateLimiter) allow(clientID string) bool {
+	b := rl.bucketFor(clientID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.lastFill).Seconds() * float64(rl.rps)
+	if b.tokens > float64(rl.rps) {
+		b.tokens = float64(rl.rps)
+	}
+	b.lastFill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
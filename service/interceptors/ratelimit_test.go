@@ -0,0 +1,58 @@
+package interceptors
+
+import (
+	"github.com/skynetservices/skynet2/service"
+	"testing"
+)
+
+func TestTokenBucketAllowsBurstUpToRPS(t *testing.T) {
+	rl := &rateLimiter{rps: 3, buckets: make(map[string]*tokenBucket)}
+
+	for i := 0; i < 3; i++ {
+		if !rl.allow("client-a") {
+			t.Fatalf("expected request %d to be allowed within the burst", i)
+		}
+	}
+
+	if rl.allow("client-a") {
+		t.Fatal("expected the 4th immediate request to be rate limited")
+	}
+}
+
+func TestTokenBucketIsPerClient(t *testing.T) {
+	rl := &rateLimiter{rps: 1, buckets: make(map[string]*tokenBucket)}
+
+	if !rl.allow("a") {
+		t.Fatal("expected client a's first request to be allowed")
+	}
+	if !rl.allow("b") {
+		t.Fatal("expected client b's first request to be allowed - it has its own bucket")
+	}
+	if rl.allow("a") {
+		t.Fatal("expected client a's second immediate request to be limited")
+	}
+}
+
+func TestRateLimitEvictsBucketOnDisconnect(t *testing.T) {
+	rl := &rateLimiter{rps: 1, buckets: make(map[string]*tokenBucket)}
+	rl.allow("client-a")
+
+	events := make(chan service.Event, 1)
+	done := make(chan struct{})
+	go func() {
+		rl.evictOnDisconnect(events)
+		close(done)
+	}()
+
+	events <- service.ClientDisconnectedEvent{ClientID: "client-a"}
+	close(events)
+	<-done
+
+	rl.mu.Lock()
+	_, ok := rl.buckets["client-a"]
+	rl.mu.Unlock()
+
+	if ok {
+		t.Fatal("expected client-a's bucket to be evicted after its ClientDisconnectedEvent")
+	}
+}
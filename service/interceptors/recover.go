@@ -0,0 +1,23 @@
+package interceptors
+
+import (
+	"context"
+	"fmt"
+	"github.com/skynetservices/skynet2/service"
+)
+
+// Recover returns an Interceptor that converts a panic inside a
+// method call (or a later interceptor in the chain) into an RPC
+// error, instead of crashing the connection's ServeCodec goroutine.
+// Register it first with Service.Use so it wraps everything else.
+func Recover() service.Interceptor {
+	return func(ctx context.Context, info service.MethodInfo, req, resp interface{}, next service.Handler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("service: panic in %s: %v", info.Method, r)
+			}
+		}()
+
+		return next(ctx, req, resp)
+	}
+}
@@ -0,0 +1,19 @@
+package interceptors
+
+import (
+	"context"
+	"github.com/skynetservices/skynet2/service"
+	"time"
+)
+
+// Timeout returns an Interceptor that cancels the method's Context
+// after d, so a handler that selects on ctx.Done() can abort a call
+// running too long instead of holding up Shutdown indefinitely.
+func Timeout(d time.Duration) service.Interceptor {
+	return func(ctx context.Context, info service.MethodInfo, req, resp interface{}, next service.Handler) error {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+
+		return next(ctx, req, resp)
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"errors"
+	"github.com/skynetservices/skynet2/log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// restartFDEnv marks the environment variable a SIGUSR2 graceful
+// restart sets on the child process so listen() inherits the parent's
+// bound socket instead of binding a fresh one.
+const restartFDEnv = "SKYNET_RESTART_FD"
+
+// restartReadyFDEnv marks the environment variable naming the fd a
+// graceful-restart child writes one byte to once it has registered,
+// so gracefulRestart knows it's safe to unregister and hand off - see
+// signalRestartReady and waitForRestartReady.
+const restartReadyFDEnv = "SKYNET_RESTART_READY_FD"
+
+// restartReadyTimeout bounds how long gracefulRestart waits for the
+// replacement process to signal it has registered before giving up
+// and aborting the restart (leaving this process running).
+const restartReadyTimeout = 30 * time.Second
+
+var restartReadyOnce sync.Once
+
+// signalRestartReady tells a graceful-restart parent waiting in
+// gracefulRestart that this process has registered and it's safe to
+// unregister and drain. It's a no-op outside of a graceful restart
+// (restartReadyFDEnv unset) and only ever signals once.
+func signalRestartReady() {
+	restartReadyOnce.Do(func() {
+		fdStr := os.Getenv(restartReadyFDEnv)
+		if fdStr == "" {
+			return
+		}
+
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			return
+		}
+
+		f := os.NewFile(uintptr(fd), "skynet-restart-ready")
+		f.Write([]byte{1})
+		f.Close()
+	})
+}
+
+// waitForRestartReady blocks until a byte arrives on r - written by
+// the child's signalRestartReady once it has registered - or timeout
+// elapses.
+func waitForRestartReady(r *os.File, timeout time.Duration) error {
+	r.SetReadDeadline(time.Now().Add(timeout))
+
+	buf := make([]byte, 1)
+	_, err := r.Read(buf)
+	return err
+}
+
+// ServiceReloader is an optional ServiceDelegate extension. If a
+// Service's Delegate implements it, SIGHUP invokes Reload instead of
+// being ignored, letting a running service re-read its config and
+// cycle its advertisement without dropping connections.
+type ServiceReloader interface {
+	Reload(s *Service) error
+}
+
+// reload runs a SIGHUP-triggered config reload: the service is taken
+// off the advertised list, the delegate's Reload re-reads whatever
+// config it owns, and the service re-registers. Delegates that don't
+// implement ServiceReloader are left alone.
+func (s *Service) reload() {
+	reloader, ok := s.Delegate.(ServiceReloader)
+	if !ok {
+		return
+	}
+
+	s.Unregister()
+
+	err := reloader.Reload(s)
+	if err != nil {
+		log.Println(log.ERROR, "Reload failed: "+err.Error())
+		return
+	}
+
+	s.Register()
+}
+
+// gracefulRestart implements the SIGUSR2 nginx/Einhorn-style restart:
+// it hands the listening socket's fd to a freshly exec'd copy of the
+// running binary, waits for that child to come up and take over
+// advertising, then drains this process's in-flight requests and
+// exits - so a redeploy drops zero connections.
+func (s *Service) gracefulRestart() {
+	if s.rawListener == nil {
+		log.Println(log.ERROR, "Cannot graceful restart: no TCP listener to hand off")
+		return
+	}
+
+	lf, err := s.rawListener.File()
+	if err != nil {
+		log.Println(log.ERROR, "Failed to dup listener fd for graceful restart: "+err.Error())
+		return
+	}
+	defer lf.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		log.Println(log.ERROR, "Failed to create restart readiness pipe: "+err.Error())
+		return
+	}
+	defer readyR.Close()
+
+	execPath, err := os.Executable()
+	if err != nil {
+		log.Println(log.ERROR, "Failed to resolve executable for graceful restart: "+err.Error())
+		return
+	}
+
+	env := append(os.Environ(), restartFDEnv+"=3", restartReadyFDEnv+"=4")
+
+	proc, err := os.StartProcess(execPath, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, lf, readyW},
+	})
+	readyW.Close()
+	if err != nil {
+		log.Println(log.ERROR, "Failed to start replacement process: "+err.Error())
+		return
+	}
+
+	log.Printf(log.INFO, "Graceful restart: started replacement pid=%d, waiting for it to register\n", proc.Pid)
+
+	if err := waitForRestartReady(readyR, restartReadyTimeout); err != nil {
+		log.Println(log.ERROR, "Replacement process never signaled ready, aborting restart: "+err.Error())
+		return
+	}
+
+	log.Printf(log.INFO, "Graceful restart: replacement pid=%d registered, draining\n", proc.Pid)
+
+	s.Unregister()
+	s.activeRequests.Wait()
+
+	os.Exit(0)
+}
+
+// inheritedTCPListener adopts the TCP listener passed down by a parent
+// process during a SIGUSR2 graceful restart, identified by the fd
+// number in the restartFDEnv environment variable.
+func inheritedTCPListener(fdStr string) (*net.TCPListener, error) {
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "skynet-inherited-listener")
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("service: inherited fd is not a TCP listener")
+	}
+
+	return tcpListener, nil
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestWaitForRestartReadyTimesOut covers the path gracefulRestart
+// relies on to abort instead of hanging forever: a replacement
+// process that is started but never calls signalRestartReady (e.g. it
+// crashes before registering) must not block the parent indefinitely.
+func TestWaitForRestartReadyTimesOut(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	start := time.Now()
+	err = waitForRestartReady(r, 50*time.Millisecond)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected an error when nothing is ever written to the pipe")
+	}
+	if elapsed > time.Second {
+		t.Fatalf("waitForRestartReady took %v, expected it to respect the timeout", elapsed)
+	}
+}
+
+func TestWaitForRestartReadySucceedsOnSignal(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	defer r.Close()
+
+	go func() {
+		w.Write([]byte{1})
+		w.Close()
+	}()
+
+	if err := waitForRestartReady(r, time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+// RequestInfo carries per-call metadata into a reflected method
+// invocation, alongside its own args/reply pair.
+type RequestInfo struct {
+	ClientID string
+	Method   string
+
+	// Context is derived from the owning Service's lifecycle context
+	// (see Service.Start) and is cancelled when the service shuts
+	// down, so a long-running method can select on Context.Done() to
+	// abort instead of blocking Shutdown/ShutdownWithTimeout.
+	Context context.Context
+}
+
+// MethodInfo identifies the call an Interceptor is wrapping. Unlike
+// RequestInfo it carries no Context of its own - interceptors receive
+// the request Context as their own argument, since Timeout and
+// similar interceptors need to replace it for inner interceptors/the
+// handler to see.
+type MethodInfo struct {
+	ClientID string
+	Method   string
+}
+
+// Handler invokes the next step in an interceptor chain - either
+// another Interceptor or, at the end of the chain, the reflected
+// method call itself.
+type Handler func(ctx context.Context, req, resp interface{}) error
+
+// Interceptor wraps a method call for cross-cutting concerns - auth,
+// rate limiting, tracing, panic recovery, metrics - similar to
+// grpc_middleware.ChainUnaryServer. Call next to continue the chain;
+// an Interceptor that returns without calling next short-circuits the
+// call with its own error. See Service.Use and the service/interceptors
+// subpackage for built-ins.
+type Interceptor func(ctx context.Context, info MethodInfo, req, resp interface{}, next Handler) error
+
+// Use registers an Interceptor to run around every reflected method
+// call, in registration order (the first registered Interceptor is
+// outermost, same as grpc_middleware.ChainUnaryServer).
+func (s *Service) Use(i Interceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
+// chain composes s.interceptors around final into a single Handler,
+// innermost-first so the first-registered Interceptor runs first and
+// wraps everything after it.
+func (s *Service) chain(info MethodInfo, final Handler) Handler {
+	h := final
+
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor := s.interceptors[i]
+		next := h
+		h = func(ctx context.Context, req, resp interface{}) error {
+			return interceptor(ctx, info, req, resp, next)
+		}
+	}
+
+	return h
+}
+
+// ServiceRPC is registered with net/rpc as the RPC receiver serving a
+// single connection; it forwards each call by name to the matching
+// reflect.Value in Service.methods, running it through the service's
+// registered interceptor chain. clientID identifies which connection
+// this instance serves, so interceptors like RateLimit can key state
+// per client - see newClientServiceRPC.
+type ServiceRPC struct {
+	service  *Service
+	clientID string
+}
+
+// NewServiceRPC wraps s for invoking its registered methods without
+// any particular client bound (ClientInfo-keyed interceptors see an
+// empty ClientID). mux() instead uses newClientServiceRPC per
+// connection so interceptors can tell clients apart.
+func NewServiceRPC(s *Service) *ServiceRPC {
+	return &ServiceRPC{service: s}
+}
+
+// newClientServiceRPC is like NewServiceRPC but binds clientID, so
+// per-connection interceptors (RateLimit) can key off it via
+// MethodInfo.ClientID.
+func newClientServiceRPC(s *Service, clientID string) *ServiceRPC {
+	return &ServiceRPC{service: s, clientID: clientID}
+}
+
+// Forward looks up methodName in the service's registered methods and
+// invokes it as func(RequestInfo, in, out) error, wrapped by every
+// Interceptor registered with Service.Use.
+func (r *ServiceRPC) Forward(methodName string, in interface{}, out interface{}) error {
+	r.service.activeRequests.Add(1)
+	defer r.service.activeRequests.Done()
+
+	method, ok := r.service.methods[methodName]
+	if !ok {
+		return errors.New("service: unknown method " + methodName)
+	}
+
+	info := MethodInfo{ClientID: r.clientID, Method: methodName}
+
+	handler := func(ctx context.Context, req, resp interface{}) error {
+		results := method.Call([]reflect.Value{
+			reflect.ValueOf(RequestInfo{ClientID: r.clientID, Method: methodName, Context: ctx}),
+			reflect.ValueOf(req),
+			reflect.ValueOf(resp),
+		})
+
+		if err, ok := results[0].Interface().(error); ok {
+			return err
+		}
+
+		return nil
+	}
+
+	return r.service.chain(info, handler)(r.service.ctx, in, out)
+}
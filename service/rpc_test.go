@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestServiceChainOrdering(t *testing.T) {
+	s := &Service{}
+
+	var order []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, info MethodInfo, req, resp interface{}, next Handler) error {
+			order = append(order, name+":before")
+			err := next(ctx, req, resp)
+			order = append(order, name+":after")
+			return err
+		}
+	}
+
+	s.Use(record("a"))
+	s.Use(record("b"))
+
+	final := func(ctx context.Context, req, resp interface{}) error {
+		order = append(order, "final")
+		return nil
+	}
+
+	if err := s.chain(MethodInfo{Method: "Foo"}, final)(context.Background(), nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"a:before", "b:before", "final", "b:after", "a:after"}
+	if len(order) != len(want) {
+		t.Fatalf("got order %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestServiceChainShortCircuit(t *testing.T) {
+	s := &Service{}
+
+	s.Use(func(ctx context.Context, info MethodInfo, req, resp interface{}, next Handler) error {
+		return errors.New("denied")
+	})
+
+	called := false
+	final := func(ctx context.Context, req, resp interface{}) error {
+		called = true
+		return nil
+	}
+
+	err := s.chain(MethodInfo{}, final)(context.Background(), nil, nil)
+	if err == nil {
+		t.Fatal("expected an error from the short-circuiting interceptor")
+	}
+	if called {
+		t.Fatal("final handler should not run once an interceptor short-circuits")
+	}
+}
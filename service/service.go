@@ -1,9 +1,13 @@
 package service
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"github.com/skynetservices/skynet2"
 	"github.com/skynetservices/skynet2/log"
-	"github.com/skynetservices/skynet2/rpc/bsonrpc"
+	"google.golang.org/grpc"
 	"net"
 	"net/rpc"
 	"os"
@@ -11,8 +15,14 @@ import (
 	"reflect"
 	"sync"
 	"syscall"
+	"time"
 )
 
+// Returned by ShutdownWithTimeout when the drain deadline is reached before
+// all active requests finished; any connections still open at that point
+// have been forcibly closed.
+var ShutdownTimedOut = errors.New("service: shutdown timed out, forcibly closed active connections")
+
 // A Generic struct to represent any service in the SkyNet system.
 type ServiceDelegate interface {
 	Started(s *Service)
@@ -23,28 +33,96 @@ type ServiceDelegate interface {
 
 type ClientInfo struct {
 	Address net.Addr
+	Conn    net.Conn
+
+	// PeerCertificates is set when Conn is a TLS connection, from the
+	// verified chain captured after its handshake. Empty for plain
+	// TCP connections. See IsTrusted.
+	PeerCertificates []*x509.Certificate
 }
 
 type Service struct {
 	skynet.ServiceInfo
-	Delegate       ServiceDelegate
-	methods        map[string]reflect.Value
-	RPCServ        *rpc.Server
-	rpcListener    *net.TCPListener
+	Delegate    ServiceDelegate
+	methods     map[string]reflect.Value
+	RPCServ     *rpc.Server
+	rpcListener net.Listener
+
+	// rawListener is the plain TCP listener underneath rpcListener
+	// (which may be a tls.Listener wrapping it). Graceful restart
+	// needs the raw *net.TCPListener to dup its fd to the child.
+	rawListener    *net.TCPListener
 	activeRequests sync.WaitGroup
-	connectionChan chan *net.TCPConn
+	connectionChan chan net.Conn
 	registeredChan chan bool
 
 	clientMutex sync.Mutex
 	ClientInfo  map[string]ClientInfo
 
-	// for sending the signal into mux()
-	doneChan chan bool
+	// ctx governs the service's lifetime: mux() exits when it's
+	// cancelled, and it's threaded into RequestInfo.Context so
+	// long-running RPC methods can abort a shutdown promptly instead
+	// of blocking it. Set by Start; cancel is called by Shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// events fans out typed Events (TCPAcceptEvent, ClientConnectedEvent,
+	// etc.) to subscribers registered with Subscribe.
+	events *Broadcaster
 
 	// for waiting for all shutdown operations
 	doneGroup *sync.WaitGroup
 
 	shuttingDown bool
+
+	// ShutdownTimeout bounds how long Shutdown() will wait for
+	// activeRequests to drain before forcibly closing remaining
+	// connections. Zero means wait forever (the previous behavior).
+	ShutdownTimeout time.Duration
+
+	// interruptChan lets a second termination signal received while
+	// already draining cut the ShutdownTimeout wait short.
+	interruptChan chan bool
+
+	// codecs are tried, in registration order, against each new
+	// connection's sniffed prefix; defaultCodec (BSONCodec) handles
+	// anything none of them claim. See RegisterCodec.
+	codecs       []Codec
+	defaultCodec Codec
+
+	// grpcServer/grpcListener are non-nil once RegisterGRPCService has
+	// been called; mux() routes HTTP/2-prefaced connections to
+	// grpcListener instead of through the codec dispatcher.
+	grpcServer   *grpc.Server
+	grpcListener *grpcListener
+
+	// TLSConfig, if set before Start(), wraps rpcListener in
+	// tls.NewListener so connections are served over TLS. Set it with
+	// WithTLS.
+	TLSConfig *tls.Config
+
+	// TrustFunc, if set, decides whether a client's verified peer
+	// certificate should be trusted by IsTrusted. When nil, IsTrusted
+	// falls back to checking the certificate's CN/SANs against
+	// TrustedNames.
+	TrustFunc func(cert *x509.Certificate) bool
+
+	// TrustedNames is the CN/SAN allow-list IsTrusted checks a peer
+	// certificate against when TrustFunc is nil.
+	TrustedNames []string
+
+	// interceptors wrap every reflected method call, in registration
+	// order. See Use and ServiceRPC.Forward.
+	interceptors []Interceptor
+}
+
+// WithTLS enables TLS on s's listener: once Start binds, rpcListener
+// is wrapped with tls.NewListener(cfg). Returns s so it can be chained
+// onto CreateService. Peer certificates presented during each
+// connection's handshake are captured into ClientInfo for IsTrusted.
+func (s *Service) WithTLS(cfg *tls.Config) *Service {
+	s.TLSConfig = cfg
+	return s
 }
 
 // Wraps your custom service in Skynet
@@ -52,15 +130,27 @@ func CreateService(sd ServiceDelegate, c skynet.ServiceConfig) (s *Service) {
 	s = &Service{
 		Delegate:       sd,
 		methods:        make(map[string]reflect.Value),
-		connectionChan: make(chan *net.TCPConn),
+		connectionChan: make(chan net.Conn),
 		registeredChan: make(chan bool),
 		ClientInfo:     make(map[string]ClientInfo),
 		shuttingDown:   false,
+		interruptChan:  make(chan bool, 1),
+		defaultCodec:   BSONCodec{},
+		events:         NewBroadcaster(),
 	}
 
+	// Start is expected to replace this with its own ctx, but give the
+	// zero-value Service a valid, already-cancellable one so nothing
+	// reading s.ctx before Start panics.
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
 	s.ServiceConfig = &c
 
-	// the main rpc server
+	// the main rpc server - kept for any external code that reflects
+	// on it directly; actual connections are served by mux() through
+	// a per-connection server bound to that connection's clientID
+	// (see newClientServiceRPC), so interceptors like RateLimit can
+	// tell clients apart.
 	s.RPCServ = rpc.NewServer()
 	rpcForwarder := NewServiceRPC(s)
 	s.RPCServ.RegisterName(s.ServiceConfig.Name, rpcForwarder)
@@ -73,6 +163,17 @@ func (s *Service) Register() {
 	s.registeredChan <- true
 }
 
+// Subscribe returns a channel delivering every Event this Service
+// publishes whose Topic is in topics, or every Event if topics is
+// empty - see the Event types in broadcaster.go (TCPAcceptEvent,
+// HandshakeFailedEvent, ClientConnectedEvent, ClientDisconnectedEvent,
+// RegisteredEvent, UnregisteredEvent). Delivery is non-blocking: a
+// subscriber that falls behind has events dropped rather than
+// stalling the service, see Broadcaster.Dropped.
+func (s *Service) Subscribe(topics ...string) <-chan Event {
+	return s.events.Subscribe(topics...)
+}
+
 func (s *Service) register() {
 	// this version must be run from the mux() goroutine
 	if s.Registered {
@@ -87,6 +188,8 @@ func (s *Service) register() {
 	s.Registered = true
 	log.Printf(log.INFO, "%+v\n", ServiceRegistered{s.ServiceConfig})
 	s.Delegate.Registered(s) // Call user defined callback
+	s.events.Publish(RegisteredEvent{})
+	signalRestartReady()
 }
 
 // Leave your service online, but notify the cluster it's not currently accepting new requests
@@ -108,10 +211,26 @@ func (s *Service) unregister() {
 	s.Registered = false
 	log.Printf(log.INFO, "%+v\n", ServiceUnregistered{s.ServiceConfig})
 	s.Delegate.Unregistered(s) // Call user defined callback
+	s.events.Publish(UnregisteredEvent{})
 }
 
-// Wait for existing requests to complete and shutdown service
+// Wait for existing requests to complete and shutdown service, bounded
+// by ShutdownTimeout (zero waits forever). See ShutdownWithTimeout to
+// pass an explicit deadline instead.
 func (s *Service) Shutdown() {
+	err := s.ShutdownWithTimeout(s.ShutdownTimeout)
+	if err != nil {
+		log.Println(log.ERROR, err.Error())
+	}
+}
+
+// Wait up to d for existing requests to complete, then shutdown service.
+// The listener is closed immediately so no new connections are accepted
+// while draining. If d elapses (or a subsequent SIGINT/SIGTERM arrives)
+// before activeRequests finishes, every connection still tracked in
+// ClientInfo is forcibly closed and ShutdownTimedOut is returned. d <= 0
+// waits forever, matching Shutdown()'s previous behavior.
+func (s *Service) ShutdownWithTimeout(d time.Duration) (err error) {
 	if s.shuttingDown {
 		return
 	}
@@ -121,28 +240,121 @@ func (s *Service) Shutdown() {
 	s.Unregister()
 
 	s.doneGroup.Add(1)
+	defer s.doneGroup.Done()
 
-	s.doneChan <- true
+	s.cancel()
 
-	s.activeRequests.Wait()
+	if s.rpcListener != nil {
+		s.rpcListener.Close()
+	}
 
-	err := skynet.GetServiceManager().Remove(s.ServiceInfo)
-	if err != nil {
-		log.Println(log.ERROR, "Failed to remove service: "+err.Error())
+	drained := make(chan bool, 1)
+	go func() {
+		s.activeRequests.Wait()
+		drained <- true
+	}()
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		timeout = time.After(d)
+	}
+
+	select {
+	case <-drained:
+	case <-timeout:
+		err = ShutdownTimedOut
+		s.closeActiveConnections()
+	case <-s.interruptChan:
+		err = ShutdownTimedOut
+		s.closeActiveConnections()
+	}
+
+	rmErr := skynet.GetServiceManager().Remove(s.ServiceInfo)
+	if rmErr != nil {
+		log.Println(log.ERROR, "Failed to remove service: "+rmErr.Error())
 	}
 
 	s.Delegate.Stopped(s) // Call user defined callback
 
-	s.doneGroup.Done()
+	return
 }
 
-// TODO: Currently unimplemented
+// closeActiveConnections forcibly closes every connection still tracked
+// in ClientInfo. Used when a shutdown deadline is reached before
+// activeRequests drains naturally.
+func (s *Service) closeActiveConnections() {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	for id, ci := range s.ClientInfo {
+		if ci.Conn != nil {
+			ci.Conn.Close()
+		}
+		delete(s.ClientInfo, id)
+	}
+}
+
+// IsTrusted reports whether the client connected from addr presented a
+// peer certificate - i.e. this is a TLS connection, see WithTLS - that
+// is trusted: accepted by TrustFunc if set, otherwise present in
+// TrustedNames (checked against the certificate's CN and DNS SANs).
+// Plain TCP connections, and TLS connections whose certificate isn't
+// trusted, return false.
 func (s *Service) IsTrusted(addr net.Addr) bool {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	for _, ci := range s.ClientInfo {
+		if ci.Address == nil || ci.Address.String() != addr.String() {
+			continue
+		}
+
+		if len(ci.PeerCertificates) == 0 {
+			return false
+		}
+
+		cert := ci.PeerCertificates[0]
+
+		if s.TrustFunc != nil {
+			return s.TrustFunc(cert)
+		}
+
+		return s.trustedByName(cert)
+	}
+
 	return false
 }
 
-// Starts your skynet service, including binding to ports. Optionally register for requests at the same time. Returns a sync.WaitGroup that will block until all requests have finished
-func (s *Service) Start(register bool) (done *sync.WaitGroup) {
+func (s *Service) trustedByName(cert *x509.Certificate) bool {
+	for _, name := range s.TrustedNames {
+		if cert.Subject.CommonName == name {
+			return true
+		}
+		for _, san := range cert.DNSNames {
+			if san == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Starts your skynet service, including binding to ports. Optionally
+// register for requests at the same time. ctx governs the service's
+// lifetime: cancelling it stops mux(), and it's threaded into every
+// RequestInfo.Context so long-running RPC methods can observe the
+// cancellation. Cancelling ctx does not run Shutdown: the service is
+// not unregistered or removed, the listener is not closed, requests
+// are not drained and Stopped is not called. A nil ctx behaves as
+// context.Background(). Returns a sync.WaitGroup that will block until
+// all requests have finished.
+func (s *Service) Start(ctx context.Context, register bool) (done *sync.WaitGroup) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
 	bindWait := &sync.WaitGroup{}
 
 	bindWait.Add(1)
@@ -152,8 +364,6 @@ func (s *Service) Start(register bool) (done *sync.WaitGroup) {
 	c := make(chan os.Signal, 1)
 	go watchSignals(c, s)
 
-	s.doneChan = make(chan bool, 1)
-
 	// We must block here, we don't want to register, until we've actually bound to an ip:port
 	bindWait.Wait()
 
@@ -190,11 +400,21 @@ func (s *Service) getClientInfo(clientID string) (ci ClientInfo, ok bool) {
 
 func (s *Service) listen(addr skynet.BindAddr, bindWait *sync.WaitGroup) {
 	var err error
-	s.rpcListener, err = addr.Listen()
+
+	if fdStr := os.Getenv(restartFDEnv); fdStr != "" {
+		s.rawListener, err = inheritedTCPListener(fdStr)
+	} else {
+		s.rawListener, err = addr.Listen()
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	s.rpcListener = s.rawListener
+	if s.TLSConfig != nil {
+		s.rpcListener = tls.NewListener(s.rpcListener, s.TLSConfig)
+	}
+
 	log.Printf(log.INFO, "%+v\n", ServiceListening{
 		Addr:          &addr,
 		ServiceConfig: s.ServiceConfig,
@@ -203,8 +423,14 @@ func (s *Service) listen(addr skynet.BindAddr, bindWait *sync.WaitGroup) {
 	bindWait.Done()
 
 	for {
-		conn, err := s.rpcListener.AcceptTCP()
+		conn, err := s.rpcListener.Accept()
 		if err != nil {
+			// ShutdownWithTimeout closes rpcListener to stop new
+			// connections; that's this goroutine's normal exit, not a
+			// crash.
+			if s.ctx.Err() != nil {
+				return
+			}
 			panic(err)
 		}
 		s.connectionChan <- conn
@@ -218,71 +444,139 @@ loop:
 	for {
 		select {
 		case conn := <-s.connectionChan:
-			clientID := skynet.UUID()
-
-			s.clientMutex.Lock()
-			s.ClientInfo[clientID] = ClientInfo{
-				Address: conn.RemoteAddr(),
-			}
-			s.clientMutex.Unlock()
-
-			// send the server handshake
-			sh := skynet.ServiceHandshake{
-				Registered: s.Registered,
-				ClientID:   clientID,
-			}
-			encoder := bsonrpc.NewEncoder(conn)
-			err := encoder.Encode(sh)
-			if err != nil {
-				log.Println(log.ERROR, err.Error())
-				break
-			}
-			if !s.Registered {
-				conn.Close()
-				break
-			}
-
-			// read the client handshake
-			var ch skynet.ClientHandshake
-			decoder := bsonrpc.NewDecoder(conn)
-			err = decoder.Decode(&ch)
-			if err != nil {
-				log.Println(log.ERROR, "Error calling bsonrpc.NewDecoder: "+err.Error())
-				break
-			}
-
-			// here do stuff with the client handshake
-			go func() {
-				s.RPCServ.ServeCodec(bsonrpc.NewServerCodec(conn))
-			}()
+			s.events.Publish(TCPAcceptEvent{Addr: conn.RemoteAddr()})
+			go s.handleConnection(conn, skynet.UUID())
 		case register := <-s.registeredChan:
 			if register {
 				s.register()
 			} else {
 				s.unregister()
 			}
-		case _ = <-s.doneChan:
-			go func() {
-				for _ = range s.doneChan {
-				}
-			}()
+		case <-s.ctx.Done():
 			break loop
 		}
 	}
 }
 
+// handleConnection runs a single accepted connection's TLS handshake,
+// codec sniff, and Skynet handshake, then serves RPCs on it until it
+// disconnects. It runs off mux()'s goroutine so a slow or stalled
+// client - in particular one selectCodec has to wait out the sniff
+// timeout for - can't hold up accepting, (un)registering, or shutdown
+// for every other client.
+func (s *Service) handleConnection(conn net.Conn, clientID string) {
+	var peerCerts []*x509.Certificate
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println(log.ERROR, "TLS handshake failed: "+err.Error())
+			s.events.Publish(HandshakeFailedEvent{Addr: conn.RemoteAddr(), Err: err})
+			conn.Close()
+			return
+		}
+		if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			peerCerts = chains[0]
+		}
+	}
+
+	s.clientMutex.Lock()
+	s.ClientInfo[clientID] = ClientInfo{
+		Address:          conn.RemoteAddr(),
+		Conn:             conn,
+		PeerCertificates: peerCerts,
+	}
+	s.clientMutex.Unlock()
+
+	forget := func() {
+		s.clientMutex.Lock()
+		delete(s.ClientInfo, clientID)
+		s.clientMutex.Unlock()
+	}
+
+	cs := newConnSniffer(conn)
+
+	if s.grpcServer != nil && looksLikeGRPC(cs) {
+		// Ownership passes to grpcServer for the connection's life;
+		// it has no hook back into ClientInfo.
+		s.grpcListener.connC <- cs
+		return
+	}
+
+	codec := s.selectCodec(cs)
+
+	// send the server handshake
+	sh := skynet.ServiceHandshake{
+		Registered: s.Registered,
+		ClientID:   clientID,
+	}
+	if err := codec.EncodeHandshake(cs, sh); err != nil {
+		log.Println(log.ERROR, err.Error())
+		s.events.Publish(HandshakeFailedEvent{Addr: conn.RemoteAddr(), Err: err})
+		forget()
+		return
+	}
+	if !s.Registered {
+		conn.Close()
+		forget()
+		return
+	}
+
+	// read the client handshake
+	if _, err := codec.DecodeHandshake(cs); err != nil {
+		log.Println(log.ERROR, "Error decoding client handshake: "+err.Error())
+		s.events.Publish(HandshakeFailedEvent{Addr: conn.RemoteAddr(), Err: err})
+		forget()
+		return
+	}
+
+	s.events.Publish(ClientConnectedEvent{ClientID: clientID, Addr: conn.RemoteAddr()})
+
+	// here do stuff with the client handshake - each connection gets
+	// its own rpc.Server bound to this clientID so interceptors can
+	// key per-client state.
+	clientRPCServ := rpc.NewServer()
+	clientRPCServ.RegisterName(s.ServiceConfig.Name, newClientServiceRPC(s, clientID))
+	clientRPCServ.ServeCodec(codec.NewServerCodec(cs))
+
+	forget()
+	s.events.Publish(ClientDisconnectedEvent{ClientID: clientID, Addr: conn.RemoteAddr()})
+}
+
 func watchSignals(c chan os.Signal, s *Service) {
-	signal.Notify(c, syscall.SIGINT, syscall.SIGKILL, syscall.SIGSEGV, syscall.SIGSTOP, syscall.SIGTERM)
+	// SIGKILL and SIGSTOP can't be caught, so only register the
+	// catchable signals we actually act on.
+	signal.Notify(c,
+		syscall.SIGINT, syscall.SIGQUIT, syscall.SIGSEGV, syscall.SIGTERM,
+		syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2,
+	)
 
 	for {
 		select {
 		case sig := <-c:
 			switch sig.(syscall.Signal) {
 			// Trap signals for clean shutdown
-			case syscall.SIGINT, syscall.SIGKILL, syscall.SIGQUIT,
-				syscall.SIGSEGV, syscall.SIGSTOP, syscall.SIGTERM:
+			case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGSEGV, syscall.SIGTERM:
 				log.Printf(log.INFO, "%+v", KillSignal{sig.(syscall.Signal)})
-				s.Shutdown()
+				if s.shuttingDown {
+					// Already draining - let a repeat signal
+					// short-circuit ShutdownWithTimeout's wait.
+					select {
+					case s.interruptChan <- true:
+					default:
+					}
+				} else {
+					// Run the drain off this goroutine so a repeat
+					// signal can still be received while it waits.
+					go s.Shutdown()
+				}
+			case syscall.SIGHUP:
+				log.Println(log.INFO, "Received SIGHUP, reloading")
+				s.reload()
+			case syscall.SIGUSR1:
+				log.Println(log.INFO, "Received SIGUSR1, reopening logs")
+				log.Reopen()
+			case syscall.SIGUSR2:
+				log.Println(log.INFO, "Received SIGUSR2, starting graceful restart")
+				s.gracefulRestart()
 			}
 		}
 	}